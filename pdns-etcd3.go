@@ -25,9 +25,13 @@ import (
   "strings"
   "strconv"
   "regexp"
+  "sort"
+  "sync"
   "net"
+  "flag"
   "golang.org/x/net/context"
   "github.com/coreos/etcd/clientv3"
+  "github.com/miekg/dns"
 )
 
 type pdnsRequest struct {
@@ -43,6 +47,7 @@ var (
   cli *clientv3.Client
   timeout = 2 * time.Second
   prefix = ""
+  autoPtr = false
 )
 
 var (
@@ -51,14 +56,163 @@ var (
   nextZoneId int32 = 1
 )
 
-var defaults struct {
+// cache mirrors the whole "<prefix>/" etcd range (records and "-defaults"
+// blobs alike) in memory, kept up to date by watchCache(). lookup() and
+// list() read from it instead of hitting etcd on every request.
+type cacheTree struct {
+  mu sync.RWMutex
+  ready bool
   revision int64
-  what2values map[string]map[string]interface{} // what = "example.net" or "example.net/subdomain" or "example.net/[subdomain/]RR" => values
+  values map[string][]byte
+  keys []string // sorted ascending, kept in step with values
+}
+
+var cache = &cacheTree{values: map[string][]byte{}}
+
+func (t *cacheTree) isReady() bool {
+  t.mu.RLock()
+  defer t.mu.RUnlock()
+  return t.ready
+}
+
+func (t *cacheTree) getRevision() int64 {
+  t.mu.RLock()
+  defer t.mu.RUnlock()
+  return t.revision
+}
+
+func (t *cacheTree) setRevision(revision int64) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  t.revision = revision
+}
+
+func (t *cacheTree) markReady(revision int64) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  t.ready = true
+  t.revision = revision
+}
+
+func (t *cacheTree) put(key string, value []byte) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if _, exists := t.values[key]; !exists {
+    idx := sort.SearchStrings(t.keys, key)
+    t.keys = append(t.keys, "")
+    copy(t.keys[idx+1:], t.keys[idx:])
+    t.keys[idx] = key
+  }
+  valueCopy := make([]byte, len(value))
+  copy(valueCopy, value)
+  t.values[key] = valueCopy
+}
+
+func (t *cacheTree) remove(key string) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if _, exists := t.values[key]; !exists { return }
+  delete(t.values, key)
+  idx := sort.SearchStrings(t.keys, key)
+  if idx < len(t.keys) && t.keys[idx] == key {
+    t.keys = append(t.keys[:idx], t.keys[idx+1:]...)
+  }
+}
+
+func (t *cacheTree) get(key string) ([]byte, bool) {
+  t.mu.RLock()
+  defer t.mu.RUnlock()
+  v, ok := t.values[key]
+  return v, ok
+}
+
+func (t *cacheTree) getPrefix(pfx string) map[string][]byte {
+  t.mu.RLock()
+  defer t.mu.RUnlock()
+  result := map[string][]byte{}
+  idx := sort.SearchStrings(t.keys, pfx)
+  for ; idx < len(t.keys) && strings.HasPrefix(t.keys[idx], pfx); idx++ {
+    result[t.keys[idx]] = t.values[t.keys[idx]]
+  }
+  return result
+}
+
+// loadCacheSnapshot does a full range GET of "<prefix>/" and populates
+// cache from it, marking the cache ready at the revision the GET was
+// served at. Used both for the initial load and to resync after a
+// watch-side compaction error.
+func loadCacheSnapshot(ctx context.Context, pfx string) (int64, error) {
+  response, err := cli.Get(ctx, pfx+"/", clientv3.WithPrefix())
+  if err != nil { return 0, err }
+  for _, item := range response.Kvs {
+    cache.put(string(item.Key), item.Value)
+  }
+  cache.markReady(response.Header.Revision)
+  if autoPtr {
+    // indexed after markReady so indexPtrCandidate's defaults lookups hit
+    // the now-complete cache instead of falling back to etcd per record
+    for _, item := range response.Kvs {
+      indexPtrCandidate(ctx, string(item.Key), item.Value)
+    }
+  }
+  return response.Header.Revision, nil
+}
+
+// watchCache keeps cache in sync with etcd from the revision it was last
+// loaded/synced at. It never returns: on watch-channel errors it retries
+// with a linearly increasing, capped backoff, resyncing with a fresh
+// loadCacheSnapshot when the error indicates the watched revision got
+// compacted away.
+func watchCache(ctx context.Context, pfx string) {
+  revision := cache.getRevision()
+  retry := 0
+  const maxRetryDelay = 30 * time.Second
+  for {
+    watchCtx, cancel := context.WithCancel(ctx)
+    watchChan := cli.Watch(watchCtx, pfx+"/", clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+    failed := false
+    for resp := range watchChan {
+      if err := resp.Err(); err != nil {
+        log.Println("cache: watch error:", err)
+        if strings.Contains(err.Error(), "compacted") {
+          if newRevision, rerr := loadCacheSnapshot(ctx, pfx); rerr == nil {
+            revision = newRevision
+          } else {
+            log.Println("cache: resync after compaction failed:", rerr)
+          }
+        }
+        failed = true
+        break
+      }
+      for _, ev := range resp.Events {
+        switch ev.Type {
+          case clientv3.EventTypePut:
+            cache.put(string(ev.Kv.Key), ev.Kv.Value)
+            if autoPtr { indexPtrCandidate(ctx, string(ev.Kv.Key), ev.Kv.Value) }
+          case clientv3.EventTypeDelete:
+            cache.remove(string(ev.Kv.Key))
+            if autoPtr { ptrIndex.remove(string(ev.Kv.Key)) }
+        }
+      }
+      revision = resp.Header.Revision
+      cache.setRevision(revision)
+    }
+    cancel()
+    if failed { retry++ } else { retry = 0 }
+    delay := time.Duration(retry) * time.Second
+    if delay > maxRetryDelay { delay = maxRetryDelay }
+    log.Println("cache: watch channel closed, reconnecting in", delay)
+    time.Sleep(delay)
+  }
 }
 
 func main() {
   log.SetPrefix(fmt.Sprintf("pdns-etcd3[%d]: ", os.Getpid()))
   log.SetFlags(0)
+  if len(os.Args) > 1 && (os.Args[1] == "import" || os.Args[1] == "export") {
+    runZoneTool(os.Args[1], os.Args[2:])
+    return
+  }
   dec := json.NewDecoder(os.Stdin)
   enc := json.NewEncoder(os.Stdout)
   var request pdnsRequest
@@ -77,6 +231,24 @@ func main() {
     }
   }
   logMessages = append(logMessages, fmt.Sprintf("prefix: '%s'", prefix))
+  warmCache := false
+  if wc, ok := request.Parameters["warm-cache"]; ok {
+    if wc, ok := wc.(bool); ok {
+      warmCache = wc
+    } else {
+      fatal(enc, "parameters.warm-cache is not a bool")
+    }
+  }
+  if ap, ok := request.Parameters["autoPtr"]; ok {
+    if ap, ok := ap.(bool); ok {
+      autoPtr = ap
+    } else {
+      fatal(enc, "parameters.autoPtr is not a bool")
+    }
+  }
+  if autoPtr {
+    logMessages = append(logMessages, "autoPtr enabled")
+  }
   if configFile, ok := request.Parameters["configFile"]; ok {
     if configFile, ok := configFile.(string); ok {
       if client, err := clientv3.NewFromConfigFile(configFile); err == nil {
@@ -130,6 +302,22 @@ func main() {
   }
   defer cli.Close()
   // TODO check storage version
+  cacheCtx := context.Background()
+  if warmCache {
+    logMessages = append(logMessages, "warming cache")
+    if _, err := loadCacheSnapshot(cacheCtx, prefix); err != nil {
+      fatal(enc, "Failed to warm cache: " + err.Error())
+    }
+    go watchCache(cacheCtx, prefix)
+  } else {
+    go func() {
+      if _, err := loadCacheSnapshot(cacheCtx, prefix); err != nil {
+        log.Println("cache: initial snapshot failed:", err)
+        return
+      }
+      watchCache(cacheCtx, prefix)
+    }()
+  }
   respond(enc, true, logMessages...)
   log.Println("initialized.", strings.Join(logMessages, ". "))
   // main loop
@@ -147,6 +335,17 @@ func main() {
     var err error
     switch request.Method {
       case "lookup": result, err = lookup(request.Parameters)
+      case "list": result, err = list(request.Parameters)
+      case "getAllDomains": result, err = getAllDomains(request.Parameters)
+      case "getAllDomainMetadata": result, err = getAllDomainMetadata(request.Parameters)
+      case "getDomainMetadata": result, err = getDomainMetadata(request.Parameters)
+      case "getDomainKeys": result, err = getDomainKeys(request.Parameters)
+      case "addDomainKey": result, err = addDomainKey(request.Parameters)
+      case "removeDomainKey": result, err = removeDomainKey(request.Parameters)
+      case "activateDomainKey": result, err = activateDomainKey(request.Parameters)
+      case "deactivateDomainKey": result, err = deactivateDomainKey(request.Parameters)
+      case "getBeforeAndAfterNamesAbsolute": result, err = getBeforeAndAfterNamesAbsolute(request.Parameters)
+      case "setNotified": result, err = setNotified(request.Parameters)
       default: result, err = false, errors.New("unknown/unimplemented request: " + request.AsString())
     }
     if err == nil {
@@ -185,21 +384,254 @@ func extractSubdomain(domain, zone string) string {
   return subdomain
 }
 
-func ensureDefaults(ctx context.Context, key string) error {
-  if _, ok := defaults.what2values[key]; !ok {
-    log.Println("loading defaults:", key)
-    response, err := cli.Get(ctx, key)
-    if err != nil { return err }
-    defs := map[string]interface{}{}
-    if response.Count > 0 {
-      err := json.Unmarshal(response.Kvs[0].Value, &defs)
-      if err != nil { return err }
+// unescapeDNSLabel undoes miekg/dns presentation-format escaping (\. for a
+// literal dot, \\ for a literal backslash, \DDD for a byte by decimal value)
+// so the result can be safely re-escaped later, e.g. by soa().
+func unescapeDNSLabel(s string) string {
+  var b strings.Builder
+  for i := 0; i < len(s); i++ {
+    if s[i] != '\\' {
+      b.WriteByte(s[i])
+      continue
+    }
+    if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+      if n, err := strconv.Atoi(s[i+1:i+4]); err == nil && n <= 255 {
+        b.WriteByte(byte(n))
+        i += 3
+        continue
+      }
     }
-    defaults.what2values[key] = defs
+    if i+1 < len(s) {
+      b.WriteByte(s[i+1])
+      i++
+      continue
+    }
+    b.WriteByte(s[i])
+  }
+  return b.String()
+}
+
+func isDigit(b byte) bool {
+  return b >= '0' && b <= '9'
+}
+
+// ptrEntry is what the auto-PTR index remembers about one forward A/AAAA
+// record: the qname it belongs to, the ttl it was served with and the etcd
+// key it was read from.
+type ptrEntry struct {
+  qname string
+  ttl time.Duration
+  key string
+}
+
+// ptrIndexTree maps an IP's String() form to the forward record that last
+// claimed it, keeping track of which etcd key supplied each mapping so a
+// changed or deleted A/AAAA record can be retracted correctly.
+type ptrIndexTree struct {
+  mu sync.RWMutex
+  byIP map[string]ptrEntry
+  keyToIP map[string]string
+}
+
+var ptrIndex = &ptrIndexTree{byIP: map[string]ptrEntry{}, keyToIP: map[string]string{}}
+
+func (t *ptrIndexTree) set(key, ip string, entry ptrEntry) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if oldIP, ok := t.keyToIP[key]; ok && oldIP != ip && t.byIP[oldIP].key == key {
+    delete(t.byIP, oldIP)
+  }
+  t.keyToIP[key] = ip
+  entry.key = key
+  t.byIP[ip] = entry
+}
+
+func (t *ptrIndexTree) remove(key string) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if ip, ok := t.keyToIP[key]; ok {
+    if t.byIP[ip].key == key { delete(t.byIP, ip) }
+    delete(t.keyToIP, key)
+  }
+}
+
+func (t *ptrIndexTree) lookup(ip string) (ptrEntry, bool) {
+  t.mu.RLock()
+  defer t.mu.RUnlock()
+  entry, ok := t.byIP[ip]
+  return entry, ok
+}
+
+// parseRecordKey splits a raw etcd key under "<prefix>/" back into the
+// zone/subdomain/qtype it was written with by recordKey(), rejecting
+// reserved "-defaults"/"-meta"/"-keys" bookkeeping keys.
+func parseRecordKey(key string) (zone, subdomain, qtype string, ok bool) {
+  rest := strings.TrimPrefix(key, prefix+"/")
+  if rest == key { return "", "", "", false }
+  parts := strings.SplitN(rest, "/", 3)
+  if len(parts) < 3 { return "", "", "", false }
+  zone, subdomain, qtypeAndRest := parts[0], parts[1], parts[2]
+  if strings.HasPrefix(subdomain, "-") { return "", "", "", false }
+  qtype = qtypeAndRest
+  if idx := strings.Index(qtype, "/"); idx >= 0 { qtype = qtype[0:idx] }
+  if strings.HasSuffix(qtype, "-defaults") { return "", "", "", false }
+  return zone, subdomain, qtype, true
+}
+
+func subdomainToQname(zone, subdomain string) string {
+  if subdomain == "@" { return zone }
+  return subdomain + "." + zone
+}
+
+// indexPtrCandidate (re-)resolves the A/AAAA record at key, if any, and
+// keeps ptrIndex in step with it. Anything that isn't presently a valid
+// A/AAAA record is retracted from the index.
+func indexPtrCandidate(ctx context.Context, key string, value []byte) {
+  zone, subdomain, qtype, ok := parseRecordKey(key)
+  if !ok || (qtype != "A" && qtype != "AAAA") {
+    ptrIndex.remove(key)
+    return
+  }
+  if len(value) == 0 {
+    ptrIndex.remove(key)
+    return
+  }
+  var obj map[string]interface{}
+  if value[0] != '{' {
+    // a raw (non-JSON) value is the record content itself, as in resolveItem()
+    obj = map[string]interface{}{"ip": string(value)}
+  } else if err := json.Unmarshal(value, &obj); err != nil {
+    ptrIndex.remove(key)
+    return
+  }
+  qp := &queryParts{zone: zone, subdomain: subdomain, qtype: qtype}
+  subdomainQtypeDefaults, err := getDefaults(ctx, qp.zoneSubdomainQtypeDefaultsKey())
+  if err != nil { ptrIndex.remove(key); return }
+  subdomainDefaults, err := getDefaults(ctx, qp.zoneSubdomainDefaultsKey())
+  if err != nil { ptrIndex.remove(key); return }
+  qtypeDefaults, err := getDefaults(ctx, qp.zoneQtypeDefaultsKey())
+  if err != nil { ptrIndex.remove(key); return }
+  zoneDefaults, err := getDefaults(ctx, qp.zoneDefaultsKey())
+  if err != nil { ptrIndex.remove(key); return }
+  valuesChain := []map[string]interface{}{obj, subdomainQtypeDefaults, subdomainDefaults, qtypeDefaults, zoneDefaults}
+  var content string
+  var ttl time.Duration
+  if qtype == "A" {
+    content, ttl, err = a(valuesChain, qp)
   } else {
-    log.Println("reusing defaults:", key)
+    content, ttl, err = aaaa(valuesChain, qp)
   }
-  return nil
+  if err != nil {
+    ptrIndex.remove(key)
+    return
+  }
+  ip := net.ParseIP(content)
+  if ip == nil {
+    ptrIndex.remove(key)
+    return
+  }
+  forwardQname := subdomainToQname(zone, subdomain)
+  if !strings.HasSuffix(forwardQname, ".") { forwardQname += "." }
+  ptrIndex.set(key, ip.String(), ptrEntry{qname: forwardQname, ttl: ttl})
+}
+
+// decodeReverseName turns a reverse-zone qname ("4.3.2.1.in-addr.arpa." or
+// the ip6.arpa nibble form) back into the net.IP it encodes.
+func decodeReverseName(qname string) (net.IP, error) {
+  name := strings.ToLower(strings.TrimSuffix(qname, "."))
+  switch {
+    case strings.HasSuffix(name, ".in-addr.arpa"):
+      base := strings.TrimSuffix(name, ".in-addr.arpa")
+      labels := strings.Split(base, ".")
+      if len(labels) != 4 { return nil, errors.New("invalid in-addr.arpa name: expected 4 octets") }
+      ip := net.IP{0, 0, 0, 0}
+      for i, l := range labels {
+        v, err := strconv.ParseUint(l, 10, 8)
+        if err != nil { return nil, errors.New("invalid in-addr.arpa octet: " + err.Error()) }
+        ip[3-i] = byte(v)
+      }
+      return ip, nil
+    case strings.HasSuffix(name, ".ip6.arpa"):
+      base := strings.TrimSuffix(name, ".ip6.arpa")
+      labels := strings.Split(base, ".")
+      if len(labels) != 32 { return nil, errors.New("invalid ip6.arpa name: expected 32 nibbles") }
+      ip := make(net.IP, 16)
+      for i, l := range labels {
+        if len(l) != 1 { return nil, errors.New("invalid ip6.arpa name: nibble '" + l + "' is not one hex digit") }
+        v, err := strconv.ParseUint(l, 16, 8)
+        if err != nil { return nil, errors.New("invalid ip6.arpa nibble: " + err.Error()) }
+        n := 31 - i
+        if n % 2 == 0 {
+          ip[n/2] |= byte(v) << 4
+        } else {
+          ip[n/2] |= byte(v)
+        }
+      }
+      return ip, nil
+    default:
+      return nil, errors.New("not a reverse (in-addr.arpa/ip6.arpa) name")
+  }
+}
+
+func isReverseZone(zone string) bool {
+  z := strings.ToLower(strings.TrimSuffix(zone, "."))
+  return strings.HasSuffix(z, "in-addr.arpa") || strings.HasSuffix(z, "ip6.arpa")
+}
+
+// forwardZoneAllowed enforces the optional "<prefix>/<reverse-zone>/-autoptr"
+// scoping ({"forwardZones":["example.com"]}): with no such blob, every
+// forward zone may populate the reverse zone.
+func forwardZoneAllowed(ctx context.Context, reverseZone, forwardQname string) (bool, error) {
+  scope, err := getDefaults(ctx, prefix+"/"+reverseZone+"/-autoptr")
+  if err != nil { return false, err }
+  rawZones, ok := scope["forwardZones"]
+  if !ok { return true, nil }
+  zones, ok := rawZones.([]interface{})
+  if !ok { return false, errors.New("'forwardZones' is not an array") }
+  forwardQname = strings.ToLower(strings.TrimSuffix(forwardQname, "."))
+  for _, z := range zones {
+    zone, ok := z.(string)
+    if !ok { continue }
+    zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+    if forwardQname == zone || strings.HasSuffix(forwardQname, "."+zone) { return true, nil }
+  }
+  return false, nil
+}
+
+// autoPTRLookup synthesizes a PTR answer for a reverse-zone qname from the
+// forward A/AAAA records seen by the cache watcher, used by lookup() when
+// no explicit PTR record is stored for qp.
+func autoPTRLookup(ctx context.Context, qp *queryParts) (map[string]interface{}, bool, error) {
+  ip, err := decodeReverseName(qp.qname)
+  if err != nil { return nil, false, nil }
+  entry, ok := ptrIndex.lookup(ip.String())
+  if !ok { return nil, false, nil }
+  allowed, err := forwardZoneAllowed(ctx, qp.zone, entry.qname)
+  if err != nil { return nil, false, err }
+  if !allowed { return nil, false, nil }
+  resultQp := *qp
+  resultQp.qtype = "PTR"
+  return makeResultItem(&resultQp, entry.qname, entry.ttl), true, nil
+}
+
+// getDefaults fetches and parses a "-defaults" blob, preferring the live
+// cache (kept current by watchCache()) and only hitting etcd directly
+// while the cache hasn't finished its initial snapshot yet.
+func getDefaults(ctx context.Context, key string) (map[string]interface{}, error) {
+  defs := map[string]interface{}{}
+  if cache.isReady() {
+    if raw, ok := cache.get(key); ok {
+      if err := json.Unmarshal(raw, &defs); err != nil { return nil, err }
+    }
+    return defs, nil
+  }
+  log.Println("cache not ready yet, loading defaults from etcd:", key)
+  response, err := cli.Get(ctx, key)
+  if err != nil { return nil, err }
+  if response.Count > 0 {
+    if err := json.Unmarshal(response.Kvs[0].Value, &defs); err != nil { return nil, err }
+  }
+  return defs, nil
 }
 
 type queryParts struct {
@@ -240,85 +672,119 @@ func lookup(params map[string]interface{}) (interface{}, error) {
   }
   qp.subdomain = extractSubdomain(qp.qname, qp.zone)
   if len(qp.subdomain) == 0 { qp.subdomain = "@" }
-  opts := []clientv3.OpOption{}
-  if !qp.isSOA() {
-    opts = append(opts, clientv3.WithPrefix())
-  }
-  var response *clientv3.GetResponse
-  var err error
   ctx, cancel := context.WithTimeout(context.Background(), timeout)
   defer cancel()
   log.Println("lookup at", qp.recordKey())
-  response, err = cli.Get(ctx, qp.recordKey(), opts...) // TODO set quorum option. not in API, perhaps default now (in v3)?
+  entries, revision, err := fetchRecords(ctx, &qp)
   if err != nil { return false, err }
-  // defaults
-  if defaults.revision != response.Header.Revision {
-    // TODO recheck version
-    log.Println("clearing defaults cache. old revision:", defaults.revision, ", new revision:", response.Header.Revision)
-    defaults.revision = response.Header.Revision
-    defaults.what2values = map[string]map[string]interface{}{}
-  }
-  if response.Count > 0 {
-    // TODO *lazy* loading of defaults
-    err = ensureDefaults(ctx, qp.zoneDefaultsKey())
-    if err != nil { return false, err }
-    err = ensureDefaults(ctx, qp.zoneSubdomainDefaultsKey())
-    if err != nil { return false, err }
-  }
-  if qp.isSOA() && isNewZone && response.Count > 0 {
+  if qp.isSOA() && isNewZone && len(entries) > 0 {
     qp.zoneId = nextZoneId
     nextZoneId++
     zone2id[qp.zone] = qp.zoneId
     id2zone[qp.zoneId] = qp.zone
   }
+  itemKeys := make([]string, 0, len(entries))
+  for itemKey := range entries { itemKeys = append(itemKeys, itemKey) }
+  sort.Strings(itemKeys)
   result := []map[string]interface{}{}
-  for _, item := range response.Kvs {
-    itemKey := string(item.Key)
+  for _, itemKey := range itemKeys {
     if strings.HasSuffix(itemKey, "-defaults") { continue }
-    if len(item.Value) == 0 { return false, errors.New("empty value") }
-    qp := qp // clone
-    if qp.isANY() {
-      qp.qtype = strings.TrimPrefix(itemKey, qp.recordKey())
-      idx := strings.Index(qp.qtype, "/")
-      if idx >= 0 { qp.qtype = qp.qtype[0:idx] }
-    }
-    var content string
-    var ttl time.Duration
-    err = ensureDefaults(ctx, qp.zoneQtypeDefaultsKey())
+    resultItem, err := resolveItem(ctx, qp, itemKey, entries[itemKey], revision)
     if err != nil { return false, err }
-    err = ensureDefaults(ctx, qp.zoneSubdomainQtypeDefaultsKey())
+    result = append(result, resultItem)
+  }
+  if len(result) == 0 && autoPtr && (qp.isANY() || qp.qtype == "PTR") && isReverseZone(qp.zone) {
+    // fall back to explicit PTR records above; only synthesize when none exist
+    resultItem, ok, err := autoPTRLookup(ctx, &qp)
     if err != nil { return false, err }
-    defaultsChain := []map[string]interface{}{
-      defaults.what2values[qp.zoneSubdomainQtypeDefaultsKey()],
-      defaults.what2values[qp.zoneSubdomainDefaultsKey()],
-      defaults.what2values[qp.zoneQtypeDefaultsKey()],
-      defaults.what2values[qp.zoneDefaultsKey()],
+    if ok { result = append(result, resultItem) }
+  }
+  return result, nil
+}
+
+// fetchRecords returns every etcd key/value under qp.recordKey() (a single
+// exact key for SOA, a whole prefix otherwise) together with the revision
+// they were read at. It serves from the live cache maintained by
+// watchCache() once that cache has finished its initial snapshot, and
+// falls back to a direct etcd Get until then.
+func fetchRecords(ctx context.Context, qp *queryParts) (map[string][]byte, int64, error) {
+  if cache.isReady() {
+    if qp.isSOA() {
+      entries := map[string][]byte{}
+      if v, ok := cache.get(qp.recordKey()); ok { entries[qp.recordKey()] = v }
+      return entries, cache.getRevision(), nil
     }
-    if item.Value[0] == '{' {
-      var obj map[string]interface{}
-      err = json.Unmarshal(item.Value, &obj)
-      if err != nil { return false, err }
-      err = nil
-      valuesChain := []map[string]interface{}{obj}
-      valuesChain = append(valuesChain, defaultsChain...)
-      switch qp.qtype {
-        case "SOA": content, ttl, err = soa(valuesChain, &qp, response.Header.Revision)
-        case "NS": content, ttl, err = ns(valuesChain, &qp)
-        case "A": content, ttl, err = a(valuesChain, &qp)
-        case "AAAA": content, ttl, err = aaaa(valuesChain, &qp)
-        case "PTR": content, ttl, err = ptr(valuesChain, &qp)
-        // TODO more qtypes
-        default: return false, errors.New("unknown/unimplemented qtype '" + qp.qtype + "', but have (JSON) object data for it (" + qp.recordKey() + ")")
-      }
-      if err != nil { return false, err }
-    } else {
-      content = string(item.Value)
-      ttl, err = getDuration("ttl", defaultsChain...)
-      if err != nil { return false, err }
+    return cache.getPrefix(qp.recordKey()), cache.getRevision(), nil
+  }
+  log.Println("cache not ready yet, reading from etcd:", qp.recordKey())
+  opts := []clientv3.OpOption{}
+  if !qp.isSOA() {
+    opts = append(opts, clientv3.WithPrefix())
+  }
+  response, err := cli.Get(ctx, qp.recordKey(), opts...)
+  if err != nil { return nil, 0, err }
+  entries := map[string][]byte{}
+  for _, item := range response.Kvs {
+    entries[string(item.Key)] = item.Value
+  }
+  return entries, response.Header.Revision, nil
+}
+
+// resolveItem turns a single etcd key/value pair (a stored record under
+// qp.recordKey()) into a pdns result item, expanding an "ANY" qp into the
+// concrete qtype found in itemKey and applying the same defaults chain as
+// lookup(). It is shared between lookup() (single subdomain/qtype) and
+// list() (whole-zone AXFR dump).
+func resolveItem(ctx context.Context, qp queryParts, itemKey string, itemValue []byte, revision int64) (map[string]interface{}, error) {
+  if len(itemValue) == 0 { return nil, errors.New("empty value") }
+  if qp.isANY() {
+    qp.qtype = strings.TrimPrefix(itemKey, qp.recordKey())
+    idx := strings.Index(qp.qtype, "/")
+    if idx >= 0 { qp.qtype = qp.qtype[0:idx] }
+  }
+  var content string
+  var ttl time.Duration
+  var err error
+  subdomainQtypeDefaults, err := getDefaults(ctx, qp.zoneSubdomainQtypeDefaultsKey())
+  if err != nil { return nil, err }
+  subdomainDefaults, err := getDefaults(ctx, qp.zoneSubdomainDefaultsKey())
+  if err != nil { return nil, err }
+  qtypeDefaults, err := getDefaults(ctx, qp.zoneQtypeDefaultsKey())
+  if err != nil { return nil, err }
+  zoneDefaults, err := getDefaults(ctx, qp.zoneDefaultsKey())
+  if err != nil { return nil, err }
+  defaultsChain := []map[string]interface{}{subdomainQtypeDefaults, subdomainDefaults, qtypeDefaults, zoneDefaults}
+  if itemValue[0] == '{' {
+    var obj map[string]interface{}
+    err = json.Unmarshal(itemValue, &obj)
+    if err != nil { return nil, err }
+    valuesChain := []map[string]interface{}{obj}
+    valuesChain = append(valuesChain, defaultsChain...)
+    switch qp.qtype {
+      case "SOA": content, ttl, err = soa(valuesChain, &qp, revision)
+      case "NS": content, ttl, err = ns(valuesChain, &qp)
+      case "A": content, ttl, err = a(valuesChain, &qp)
+      case "AAAA": content, ttl, err = aaaa(valuesChain, &qp)
+      case "PTR": content, ttl, err = ptr(valuesChain, &qp)
+      case "MX": content, ttl, err = mx(valuesChain, &qp)
+      case "TXT": content, ttl, err = txt(valuesChain, &qp)
+      case "SRV": content, ttl, err = srv(valuesChain, &qp)
+      case "CNAME": content, ttl, err = cname(valuesChain, &qp)
+      case "CAA": content, ttl, err = caa(valuesChain, &qp)
+      case "TLSA": content, ttl, err = tlsa(valuesChain, &qp)
+      case "NAPTR": content, ttl, err = naptr(valuesChain, &qp)
+      case "DNAME": content, ttl, err = dname(valuesChain, &qp)
+      case "SSHFP": content, ttl, err = sshfp(valuesChain, &qp)
+      // TODO more qtypes
+      default: return nil, errors.New("unknown/unimplemented qtype '" + qp.qtype + "', but have (JSON) object data for it (" + qp.recordKey() + ")")
     }
-    result = append(result, makeResultItem(&qp, content, ttl))
+    if err != nil { return nil, err }
+  } else {
+    content = string(itemValue)
+    ttl, err = getDuration("ttl", defaultsChain...)
+    if err != nil { return nil, err }
   }
-  return result, nil
+  return makeResultItem(&qp, content, ttl), nil
 }
 
 func makeResultItem(qp *queryParts, content string, ttl time.Duration) map[string]interface{} {
@@ -378,6 +844,16 @@ func getString(name string, maps ...map[string]interface{}) (string, error) {
   }
 }
 
+func getBool(name string, maps ...map[string]interface{}) (bool, error) {
+  if v, ok := findValue(name, maps...); ok {
+    if v, ok := v.(bool); ok {
+      return v, nil
+    }
+    return false, errors.New("'" + name + "' is not a bool")
+  }
+  return false, errors.New("missing '" + name + "'")
+}
+
 func getDuration(name string, maps ...map[string]interface{}) (time.Duration, error) {
   if v, ok := findValue(name, maps...); ok {
     var dur time.Duration
@@ -585,3 +1061,636 @@ func ptr(valuesChain []map[string]interface{}, qp *queryParts) (string, time.Dur
   content := fmt.Sprintf("%s", hostname)
   return content, ttl, nil
 }
+
+// validateRR checks that "<rrType> <content>" is parseable RDATA for rrType,
+// using miekg/dns as the authority on wire format. The owner name is
+// irrelevant for this purpose, so a placeholder is used.
+func validateRR(rrType, content string) error {
+  if _, err := dns.NewRR("x. IN " + rrType + " " + content); err != nil {
+    return errors.New("invalid " + rrType + " record: " + err.Error())
+  }
+  return nil
+}
+
+// quoteTXT turns a raw string into an RFC 1035 <character-string>, escaping
+// backslashes and double quotes.
+func quoteTXT(s string) string {
+  s = strings.Replace(s, "\\", "\\\\", -1)
+  s = strings.Replace(s, "\"", "\\\"", -1)
+  return "\"" + s + "\""
+}
+
+func mx(valuesChain []map[string]interface{}, qp *queryParts) (string, time.Duration, error) {
+  priority, err := getInt32("priority", valuesChain...)
+  if err != nil { return "", 0, err }
+  hostname, err := getString("hostname", valuesChain...)
+  if err != nil { return "", 0, err }
+  hostname = strings.TrimSpace(hostname)
+  hostname = fqdn(hostname, qp.zone)
+  content := fmt.Sprintf("%d %s", priority, hostname)
+  if err := validateRR("MX", content); err != nil { return "", 0, err }
+  ttl, err := getDuration("ttl", valuesChain...)
+  if err != nil { return "", 0, err }
+  return content, ttl, nil
+}
+
+func txt(valuesChain []map[string]interface{}, qp *queryParts) (string, time.Duration, error) {
+  v, ok := findValue("text", valuesChain...)
+  if !ok { return "", 0, errors.New("'text' not set") }
+  var parts []string
+  switch v.(type) {
+    case string:
+      parts = []string{v.(string)}
+    case []interface{}:
+      for i, v := range v.([]interface{}) {
+        v, ok := v.(string)
+        if !ok { return "", 0, errors.New(fmt.Sprintf("'text' part %d is not a string", i + 1)) }
+        parts = append(parts, v)
+      }
+    default:
+      return "", 0, errors.New("'text' is neither a string nor an array")
+  }
+  quoted := make([]string, len(parts))
+  for i, part := range parts { quoted[i] = quoteTXT(part) }
+  content := strings.Join(quoted, " ")
+  if err := validateRR("TXT", content); err != nil { return "", 0, err }
+  ttl, err := getDuration("ttl", valuesChain...)
+  if err != nil { return "", 0, err }
+  return content, ttl, nil
+}
+
+func srv(valuesChain []map[string]interface{}, qp *queryParts) (string, time.Duration, error) {
+  priority, err := getInt32("priority", valuesChain...)
+  if err != nil { return "", 0, err }
+  weight, err := getInt32("weight", valuesChain...)
+  if err != nil { return "", 0, err }
+  port, err := getInt32("port", valuesChain...)
+  if err != nil { return "", 0, err }
+  target, err := getString("target", valuesChain...)
+  if err != nil { return "", 0, err }
+  target = strings.TrimSpace(target)
+  target = fqdn(target, qp.zone)
+  content := fmt.Sprintf("%d %d %d %s", priority, weight, port, target)
+  if err := validateRR("SRV", content); err != nil { return "", 0, err }
+  ttl, err := getDuration("ttl", valuesChain...)
+  if err != nil { return "", 0, err }
+  return content, ttl, nil
+}
+
+func cname(valuesChain []map[string]interface{}, qp *queryParts) (string, time.Duration, error) {
+  hostname, err := getString("hostname", valuesChain...)
+  if err != nil { return "", 0, err }
+  hostname = strings.TrimSpace(hostname)
+  hostname = fqdn(hostname, qp.zone)
+  if err := validateRR("CNAME", hostname); err != nil { return "", 0, err }
+  ttl, err := getDuration("ttl", valuesChain...)
+  if err != nil { return "", 0, err }
+  content := fmt.Sprintf("%s", hostname)
+  return content, ttl, nil
+}
+
+func dname(valuesChain []map[string]interface{}, qp *queryParts) (string, time.Duration, error) {
+  hostname, err := getString("hostname", valuesChain...)
+  if err != nil { return "", 0, err }
+  hostname = strings.TrimSpace(hostname)
+  hostname = fqdn(hostname, qp.zone)
+  if err := validateRR("DNAME", hostname); err != nil { return "", 0, err }
+  ttl, err := getDuration("ttl", valuesChain...)
+  if err != nil { return "", 0, err }
+  content := fmt.Sprintf("%s", hostname)
+  return content, ttl, nil
+}
+
+func caa(valuesChain []map[string]interface{}, qp *queryParts) (string, time.Duration, error) {
+  flags, err := getInt32("flags", valuesChain...)
+  if err != nil { return "", 0, err }
+  tag, err := getString("tag", valuesChain...)
+  if err != nil { return "", 0, err }
+  value, err := getString("value", valuesChain...)
+  if err != nil { return "", 0, err }
+  content := fmt.Sprintf("%d %s %s", flags, tag, quoteTXT(value))
+  if err := validateRR("CAA", content); err != nil { return "", 0, err }
+  ttl, err := getDuration("ttl", valuesChain...)
+  if err != nil { return "", 0, err }
+  return content, ttl, nil
+}
+
+func tlsa(valuesChain []map[string]interface{}, qp *queryParts) (string, time.Duration, error) {
+  usage, err := getInt32("usage", valuesChain...)
+  if err != nil { return "", 0, err }
+  selector, err := getInt32("selector", valuesChain...)
+  if err != nil { return "", 0, err }
+  matchingType, err := getInt32("matchingtype", valuesChain...)
+  if err != nil { return "", 0, err }
+  cert, err := getString("cert", valuesChain...)
+  if err != nil { return "", 0, err }
+  cert = strings.TrimSpace(cert)
+  content := fmt.Sprintf("%d %d %d %s", usage, selector, matchingType, cert)
+  if err := validateRR("TLSA", content); err != nil { return "", 0, err }
+  ttl, err := getDuration("ttl", valuesChain...)
+  if err != nil { return "", 0, err }
+  return content, ttl, nil
+}
+
+func naptr(valuesChain []map[string]interface{}, qp *queryParts) (string, time.Duration, error) {
+  order, err := getInt32("order", valuesChain...)
+  if err != nil { return "", 0, err }
+  preference, err := getInt32("preference", valuesChain...)
+  if err != nil { return "", 0, err }
+  flags, err := getString("flags", valuesChain...)
+  if err != nil { return "", 0, err }
+  services, err := getString("services", valuesChain...)
+  if err != nil { return "", 0, err }
+  regexpField, err := getString("regexp", valuesChain...)
+  if err != nil { return "", 0, err }
+  replacement, err := getString("replacement", valuesChain...)
+  if err != nil { return "", 0, err }
+  replacement = strings.TrimSpace(replacement)
+  replacement = fqdn(replacement, qp.zone)
+  content := fmt.Sprintf("%d %d %s %s %s %s", order, preference, quoteTXT(flags), quoteTXT(services), quoteTXT(regexpField), replacement)
+  if err := validateRR("NAPTR", content); err != nil { return "", 0, err }
+  ttl, err := getDuration("ttl", valuesChain...)
+  if err != nil { return "", 0, err }
+  return content, ttl, nil
+}
+
+func sshfp(valuesChain []map[string]interface{}, qp *queryParts) (string, time.Duration, error) {
+  algorithm, err := getInt32("algorithm", valuesChain...)
+  if err != nil { return "", 0, err }
+  fpType, err := getInt32("fptype", valuesChain...)
+  if err != nil { return "", 0, err }
+  fingerprint, err := getString("fingerprint", valuesChain...)
+  if err != nil { return "", 0, err }
+  fingerprint = strings.TrimSpace(fingerprint)
+  content := fmt.Sprintf("%d %d %s", algorithm, fpType, fingerprint)
+  if err := validateRR("SSHFP", content); err != nil { return "", 0, err }
+  ttl, err := getDuration("ttl", valuesChain...)
+  if err != nil { return "", 0, err }
+  return content, ttl, nil
+}
+
+// zoneMetaPrefix/zoneMetaKey/zoneKeysPrefix/zoneKeyKey below mirror the
+// -defaults key layout: per-zone bookkeeping lives under reserved
+// "-"-prefixed subkeys next to the zone's records.
+func zoneMetaPrefix(zone string) string { return prefix + "/" + zone + "/-meta/" }
+func zoneMetaKey(zone, kind string) string { return zoneMetaPrefix(zone) + kind }
+func zoneKeysPrefix(zone string) string { return prefix + "/" + zone + "/-keys/" }
+func zoneKeyKey(zone string, id int32) string { return fmt.Sprintf("%s%d", zoneKeysPrefix(zone), id) }
+
+func zoneNameFromParams(params map[string]interface{}) (string, error) {
+  return getString("name", params)
+}
+
+func getAllDomains(params map[string]interface{}) (interface{}, error) {
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  response, err := cli.Get(ctx, prefix+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+  if err != nil { return false, err }
+  const soaSuffix = "/@/SOA"
+  domains := []map[string]interface{}{}
+  seen := map[string]bool{}
+  for _, item := range response.Kvs {
+    key := string(item.Key)
+    if !strings.HasSuffix(key, soaSuffix) { continue }
+    zone := strings.TrimSuffix(strings.TrimPrefix(key, prefix+"/"), soaSuffix)
+    if seen[zone] { continue }
+    seen[zone] = true
+    zoneId, ok := zone2id[zone]
+    if !ok {
+      zoneId = nextZoneId
+      nextZoneId++
+      zone2id[zone] = zoneId
+      id2zone[zoneId] = zone
+    }
+    domains = append(domains, map[string]interface{}{
+      "id": zoneId,
+      "zone": zone,
+      "masters": []string{},
+      "notified_serial": 0,
+      "kind": "Native",
+    })
+  }
+  return domains, nil
+}
+
+func getAllDomainMetadata(params map[string]interface{}) (interface{}, error) {
+  zone, err := zoneNameFromParams(params)
+  if err != nil { return false, err }
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  response, err := cli.Get(ctx, zoneMetaPrefix(zone), clientv3.WithPrefix())
+  if err != nil { return false, err }
+  metadata := map[string][]string{}
+  for _, item := range response.Kvs {
+    kind := strings.TrimPrefix(string(item.Key), zoneMetaPrefix(zone))
+    values := []string{}
+    if err := json.Unmarshal(item.Value, &values); err != nil { return false, err }
+    metadata[kind] = values
+  }
+  return metadata, nil
+}
+
+func getDomainMetadata(params map[string]interface{}) (interface{}, error) {
+  zone, err := zoneNameFromParams(params)
+  if err != nil { return false, err }
+  kind, err := getString("kind", params)
+  if err != nil { return false, err }
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  response, err := cli.Get(ctx, zoneMetaKey(zone, kind))
+  if err != nil { return false, err }
+  if response.Count == 0 { return []string{}, nil }
+  values := []string{}
+  if err := json.Unmarshal(response.Kvs[0].Value, &values); err != nil { return false, err }
+  return values, nil
+}
+
+func getDomainKeys(params map[string]interface{}) (interface{}, error) {
+  zone, err := zoneNameFromParams(params)
+  if err != nil { return false, err }
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  response, err := cli.Get(ctx, zoneKeysPrefix(zone), clientv3.WithPrefix())
+  if err != nil { return false, err }
+  keys := []map[string]interface{}{}
+  for _, item := range response.Kvs {
+    idStr := strings.TrimPrefix(string(item.Key), zoneKeysPrefix(zone))
+    id, err := strconv.ParseInt(idStr, 10, 32)
+    if err != nil { continue }
+    var key map[string]interface{}
+    if err := json.Unmarshal(item.Value, &key); err != nil { return false, err }
+    key["id"] = int32(id)
+    keys = append(keys, key)
+  }
+  return keys, nil
+}
+
+func nextDomainKeyId(ctx context.Context, zone string) (int32, error) {
+  response, err := cli.Get(ctx, zoneKeysPrefix(zone), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+  if err != nil { return 0, err }
+  var maxId int32 = 0
+  for _, item := range response.Kvs {
+    idStr := strings.TrimPrefix(string(item.Key), zoneKeysPrefix(zone))
+    id, err := strconv.ParseInt(idStr, 10, 32)
+    if err != nil { continue }
+    if int32(id) > maxId { maxId = int32(id) }
+  }
+  return maxId + 1, nil
+}
+
+func addDomainKey(params map[string]interface{}) (interface{}, error) {
+  zone, err := zoneNameFromParams(params)
+  if err != nil { return false, err }
+  keyParam, ok := params["key"].(map[string]interface{})
+  if !ok { return false, errors.New("'key' is not an object") }
+  flags, err := getInt32("flags", keyParam)
+  if err != nil { return false, err }
+  active, err := getBool("active", keyParam)
+  if err != nil { return false, err }
+  content, err := getString("content", keyParam)
+  if err != nil { return false, err }
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  id, err := nextDomainKeyId(ctx, zone)
+  if err != nil { return false, err }
+  value, err := json.Marshal(map[string]interface{}{"flags": flags, "active": active, "content": content})
+  if err != nil { return false, err }
+  _, err = cli.Put(ctx, zoneKeyKey(zone, id), string(value))
+  if err != nil { return false, err }
+  return id, nil
+}
+
+func removeDomainKey(params map[string]interface{}) (interface{}, error) {
+  zone, err := zoneNameFromParams(params)
+  if err != nil { return false, err }
+  id, err := getInt32("id", params)
+  if err != nil { return false, err }
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  _, err = cli.Delete(ctx, zoneKeyKey(zone, id))
+  if err != nil { return false, err }
+  return true, nil
+}
+
+func setDomainKeyActive(params map[string]interface{}, active bool) (interface{}, error) {
+  zone, err := zoneNameFromParams(params)
+  if err != nil { return false, err }
+  id, err := getInt32("id", params)
+  if err != nil { return false, err }
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  response, err := cli.Get(ctx, zoneKeyKey(zone, id))
+  if err != nil { return false, err }
+  if response.Count == 0 { return false, errors.New("no such key") }
+  var key map[string]interface{}
+  if err := json.Unmarshal(response.Kvs[0].Value, &key); err != nil { return false, err }
+  key["active"] = active
+  value, err := json.Marshal(key)
+  if err != nil { return false, err }
+  _, err = cli.Put(ctx, zoneKeyKey(zone, id), string(value))
+  if err != nil { return false, err }
+  return true, nil
+}
+
+func activateDomainKey(params map[string]interface{}) (interface{}, error) {
+  return setDomainKeyActive(params, true)
+}
+
+func deactivateDomainKey(params map[string]interface{}) (interface{}, error) {
+  return setDomainKeyActive(params, false)
+}
+
+// canonicalLabels splits name into its lowercased labels in rightmost-first
+// (TLD-first) order, as required to compare names per RFC 4034's canonical
+// DNS name ordering.
+func canonicalLabels(name string) []string {
+  name = strings.TrimSuffix(name, ".")
+  if len(name) == 0 { return []string{} }
+  labels := strings.Split(strings.ToLower(name), ".")
+  for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+    labels[i], labels[j] = labels[j], labels[i]
+  }
+  return labels
+}
+
+func canonicalLess(a, b string) bool {
+  la, lb := canonicalLabels(a), canonicalLabels(b)
+  for i := 0; i < len(la) && i < len(lb); i++ {
+    if la[i] != lb[i] { return la[i] < lb[i] }
+  }
+  return len(la) < len(lb)
+}
+
+func getBeforeAndAfterNamesAbsolute(params map[string]interface{}) (interface{}, error) {
+  zoneId, err := getInt32("id", params)
+  if err != nil { return false, err }
+  qname, err := getString("qname", params)
+  if err != nil { return false, err }
+  zone, ok := id2zone[zoneId]
+  if !ok { return false, errors.New("unknown domain id") }
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  zk := prefix + "/" + zone
+  response, err := cli.Get(ctx, zk+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+  if err != nil { return false, err }
+  seen := map[string]bool{}
+  names := []string{}
+  for _, item := range response.Kvs {
+    rest := strings.TrimPrefix(string(item.Key), zk+"/")
+    subdomain := rest
+    if idx := strings.Index(rest, "/"); idx >= 0 { subdomain = rest[0:idx] }
+    if strings.HasPrefix(subdomain, "-") { continue } // -defaults, -meta, -keys
+    name := zone + "."
+    if subdomain != "@" { name = subdomain + "." + zone + "." }
+    if seen[name] { continue }
+    seen[name] = true
+    names = append(names, name)
+  }
+  sort.Slice(names, func(i, j int) bool { return canonicalLess(names[i], names[j]) })
+  if len(names) == 0 { return false, errors.New("zone has no names") }
+  qname = fqdn(qname, zone)
+  idx := sort.Search(len(names), func(i int) bool { return !canonicalLess(names[i], qname) })
+  before := names[(idx-1+len(names))%len(names)]
+  after := names[idx%len(names)]
+  if idx < len(names) && names[idx] == qname {
+    before = names[idx]
+    after = names[(idx+1)%len(names)]
+  }
+  return map[string]interface{}{"before": before, "after": after, "unhashed": qname}, nil
+}
+
+func setNotified(params map[string]interface{}) (interface{}, error) {
+  _, err := getInt32("id", params)
+  if err != nil { return false, err }
+  _, err = getInt32("serial", params)
+  if err != nil { return false, err }
+  // notified_serial is informational only for a Native-kind backend; pdns
+  // only calls this for slaves, so there is nothing to persist here.
+  return true, nil
+}
+
+func list(params map[string]interface{}) (interface{}, error) {
+  zone, err := getString("zonename", params)
+  if err != nil { return false, err }
+  zoneId, err := getInt32("domain_id", params)
+  if err != nil { return false, err }
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  zk := prefix + "/" + zone
+  var entries map[string][]byte
+  var revision int64
+  if cache.isReady() {
+    entries = cache.getPrefix(zk + "/")
+    revision = cache.getRevision()
+  } else {
+    log.Println("cache not ready yet, reading from etcd:", zk)
+    response, err := cli.Get(ctx, zk+"/", clientv3.WithPrefix())
+    if err != nil { return false, err }
+    entries = map[string][]byte{}
+    for _, item := range response.Kvs {
+      entries[string(item.Key)] = item.Value
+    }
+    revision = response.Header.Revision
+  }
+  itemKeys := make([]string, 0, len(entries))
+  for itemKey := range entries { itemKeys = append(itemKeys, itemKey) }
+  sort.Strings(itemKeys)
+  result := []map[string]interface{}{}
+  for _, itemKey := range itemKeys {
+    rest := strings.TrimPrefix(itemKey, zk+"/")
+    subdomain := rest
+    qtype := ""
+    if idx := strings.Index(rest, "/"); idx >= 0 {
+      subdomain = rest[0:idx]
+      qtype = rest[idx+1:]
+      if idx2 := strings.Index(qtype, "/"); idx2 >= 0 { qtype = qtype[0:idx2] }
+    }
+    if strings.HasPrefix(subdomain, "-") { continue } // -defaults, -meta, -keys
+    if strings.HasSuffix(qtype, "-defaults") || qtype == "" { continue }
+    qp := queryParts{zoneId: zoneId, qname: subdomain + "." + zone, zone: zone, subdomain: subdomain, qtype: qtype}
+    if subdomain == "@" { qp.qname = zone }
+    resultItem, err := resolveItem(ctx, qp, itemKey, entries[itemKey], revision)
+    if err != nil { return false, err }
+    result = append(result, resultItem)
+  }
+  return result, nil
+}
+
+// runZoneTool implements the "import"/"export" subcommands: a one-shot CLI
+// mode for migrating a BIND-format zone file into etcd (and back out),
+// used instead of the pdns coprocess JSON protocol.
+func runZoneTool(cmd string, args []string) {
+  fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+  endpoints := fs.String("endpoints", "[::1]:2379|127.0.0.1:2379", "etcd endpoints, '|'-separated")
+  prefixFlag := fs.String("prefix", "", "etcd key prefix")
+  fs.Parse(args)
+  if fs.NArg() < 1 {
+    usage := "usage: pdns-etcd3 " + cmd + " [-prefix=...] [-endpoints=...] <zone>"
+    if cmd == "import" { usage += " [file]" }
+    log.Fatalln(usage)
+  }
+  prefix = *prefixFlag
+  cfg := clientv3.Config{DialTimeout: timeout, Endpoints: strings.Split(*endpoints, "|")}
+  client, err := clientv3.New(cfg)
+  if err != nil { log.Fatalln("Failed to create client instance:", err) }
+  cli = client
+  defer cli.Close()
+  zone := fs.Arg(0)
+  switch cmd {
+    case "import":
+      file := "-"
+      if fs.NArg() > 1 { file = fs.Arg(1) }
+      if err := importZone(zone, file); err != nil { log.Fatalln("import failed:", err) }
+    case "export":
+      if err := exportZone(zone, os.Stdout); err != nil { log.Fatalln("export failed:", err) }
+  }
+}
+
+// rrPayload translates a parsed zone-file RR into the JSON object shape
+// the lookup handlers (soa(), a(), mx(), ...) expect, so importZone can
+// write it out verbatim. zoneFqdn is needed to turn a SOA RNAME back into
+// the short "mail" form soa() re-expands with fqdn().
+func rrPayload(zoneFqdn string, rr dns.RR) (map[string]interface{}, error) {
+  ttl := int64(rr.Header().Ttl)
+  switch rr := rr.(type) {
+    case *dns.SOA:
+      mail := extractSubdomain(dns.Fqdn(rr.Mbox), zoneFqdn)
+      if len(mail) == 0 { mail = dns.Fqdn(rr.Mbox) }
+      mail = unescapeDNSLabel(mail)
+      return map[string]interface{}{
+        "primary": rr.Ns,
+        "mail": mail,
+        "refresh": int64(rr.Refresh),
+        "retry": int64(rr.Retry),
+        "expire": int64(rr.Expire),
+        "neg-ttl": int64(rr.Minttl),
+        "ttl": ttl,
+      }, nil
+    case *dns.NS:
+      return map[string]interface{}{"hostname": rr.Ns, "ttl": ttl}, nil
+    case *dns.A:
+      return map[string]interface{}{"ip": rr.A.String(), "ttl": ttl}, nil
+    case *dns.AAAA:
+      return map[string]interface{}{"ip": rr.AAAA.String(), "ttl": ttl}, nil
+    case *dns.PTR:
+      return map[string]interface{}{"hostname": rr.Ptr, "ttl": ttl}, nil
+    case *dns.CNAME:
+      return map[string]interface{}{"hostname": rr.Target, "ttl": ttl}, nil
+    case *dns.DNAME:
+      return map[string]interface{}{"hostname": rr.Target, "ttl": ttl}, nil
+    case *dns.MX:
+      return map[string]interface{}{"priority": rr.Preference, "hostname": rr.Mx, "ttl": ttl}, nil
+    case *dns.TXT:
+      text := make([]string, len(rr.Txt))
+      for i, s := range rr.Txt { text[i] = unescapeDNSLabel(s) }
+      return map[string]interface{}{"text": text, "ttl": ttl}, nil
+    case *dns.SRV:
+      return map[string]interface{}{"priority": rr.Priority, "weight": rr.Weight, "port": rr.Port, "target": rr.Target, "ttl": ttl}, nil
+    case *dns.CAA:
+      return map[string]interface{}{"flags": rr.Flag, "tag": rr.Tag, "value": unescapeDNSLabel(rr.Value), "ttl": ttl}, nil
+    case *dns.TLSA:
+      return map[string]interface{}{"usage": rr.Usage, "selector": rr.Selector, "matchingtype": rr.MatchingType, "cert": rr.Certificate, "ttl": ttl}, nil
+    case *dns.NAPTR:
+      return map[string]interface{}{"order": rr.Order, "preference": rr.Preference, "flags": unescapeDNSLabel(rr.Flags), "services": unescapeDNSLabel(rr.Service), "regexp": unescapeDNSLabel(rr.Regexp), "replacement": rr.Replacement, "ttl": ttl}, nil
+    case *dns.SSHFP:
+      return map[string]interface{}{"algorithm": rr.Algorithm, "fptype": rr.Type, "fingerprint": rr.FingerPrint, "ttl": ttl}, nil
+    default:
+      return nil, errors.New("unsupported record type for import: " + dns.TypeToString[rr.Header().Rrtype])
+  }
+}
+
+// importZone reads a BIND-format zone file (stdin if file is "-") and
+// writes every RR it contains into etcd under recordKey()'s layout. Large
+// zones are committed in sequential batches (etcd caps ops per Txn), so a
+// failure partway through can leave the zone half-imported; on failure the
+// returned error reports how many records committed before it.
+func importZone(zone, file string) error {
+  var r io.Reader
+  if file == "-" {
+    r = os.Stdin
+  } else {
+    f, err := os.Open(file)
+    if err != nil { return err }
+    defer f.Close()
+    r = f
+  }
+  zoneFqdn := dns.Fqdn(zone)
+  zp := dns.NewZoneParser(r, zoneFqdn, file)
+  ops := []clientv3.Op{}
+  counters := map[string]int{}
+  for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+    hdr := rr.Header()
+    payload, err := rrPayload(zoneFqdn, rr)
+    if err != nil { return err }
+    subdomain := extractSubdomain(dns.Fqdn(hdr.Name), zoneFqdn)
+    if len(subdomain) == 0 { subdomain = "@" }
+    qtype := dns.TypeToString[hdr.Rrtype]
+    key := prefix + "/" + zoneFqdn + "/" + subdomain + "/" + qtype
+    if qtype != "SOA" {
+      idx := counters[key]
+      counters[key] = idx + 1
+      key = fmt.Sprintf("%s/%d", key, idx)
+    }
+    value, err := json.Marshal(payload)
+    if err != nil { return err }
+    ops = append(ops, clientv3.OpPut(key, string(value)))
+  }
+  if err := zp.Err(); err != nil { return err }
+  if len(ops) == 0 {
+    log.Println("no records found in zone file for", zone)
+    return nil
+  }
+  // etcd rejects a Txn with more than --max-txn-ops operations (128 by
+  // default), so large zones are committed in sequential batches well
+  // under that limit rather than as a single transaction.
+  const txnBatchSize = 100
+  for start := 0; start < len(ops); start += txnBatchSize {
+    end := start + txnBatchSize
+    if end > len(ops) { end = len(ops) }
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    _, err := cli.Txn(ctx).Then(ops[start:end]...).Commit()
+    cancel()
+    if err != nil {
+      return errors.New(fmt.Sprintf("import of zone %s failed after committing %d/%d records: %s", zone, start, len(ops), err.Error()))
+    }
+  }
+  log.Println("imported", len(ops), "records into zone", zone)
+  return nil
+}
+
+// exportZone iterates every record stored for zone and writes it back out
+// as a BIND-format zone file, reusing resolveItem() (and so the same
+// defaults chain and per-type content formatting lookup() uses) to turn
+// each etcd entry into RDATA text.
+func exportZone(zone string, w io.Writer) error {
+  zoneFqdn := dns.Fqdn(zone)
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  zk := prefix + "/" + zoneFqdn
+  response, err := cli.Get(ctx, zk+"/", clientv3.WithPrefix())
+  if err != nil { return err }
+  keys := make([]string, 0, len(response.Kvs))
+  values := map[string][]byte{}
+  for _, item := range response.Kvs {
+    keys = append(keys, string(item.Key))
+    values[string(item.Key)] = item.Value
+  }
+  sort.Strings(keys)
+  count := 0
+  for _, key := range keys {
+    keyZone, subdomain, qtype, ok := parseRecordKey(key)
+    if !ok || keyZone != zoneFqdn { continue }
+    qname := subdomainToQname(zoneFqdn, subdomain)
+    if !strings.HasSuffix(qname, ".") { qname += "." }
+    qp := queryParts{zone: zoneFqdn, subdomain: subdomain, qtype: qtype, qname: qname}
+    resultItem, err := resolveItem(ctx, qp, key, values[key], response.Header.Revision)
+    if err != nil { return err }
+    line := fmt.Sprintf("%s %d IN %s %s", resultItem["qname"], resultItem["ttl"], qtype, resultItem["content"])
+    rr, err := dns.NewRR(line)
+    if err != nil { return err }
+    fmt.Fprintln(w, rr.String())
+    count++
+  }
+  log.Println("exported", count, "records from zone", zone)
+  return nil
+}